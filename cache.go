@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const cachePrefixSize = 64 * 1024
+
+// cacheBaseDir is the shared mp3-check cache directory, used both for the
+// scan cache below and the fingerprint cache.
+func cacheBaseDir() string {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, ".cache")
+	}
+
+	return filepath.Join(base, "mp3-check")
+}
+
+func defaultScanCachePath() string {
+	dir := cacheBaseDir()
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, "scan-cache.json")
+}
+
+func hashFilePrefix(path string, n int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha1.New()
+	if _, err := io.CopyN(hasher, file, n); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+type cachedSilence struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+func silencesToCache(s []silence) []cachedSilence {
+	out := make([]cachedSilence, len(s))
+	for i, v := range s {
+		out[i] = cachedSilence{Start: v.start, End: v.end}
+	}
+
+	return out
+}
+
+func silencesFromCache(s []cachedSilence) []silence {
+	out := make([]silence, len(s))
+	for i, v := range s {
+		out[i] = silence{start: v.Start, end: v.End}
+	}
+
+	return out
+}
+
+// scanCacheEntry is the on-disk record of an already-analysed track, so
+// that a rescan can skip the ffmpeg silencedetect pass entirely.
+type scanCacheEntry struct {
+	Silences     []cachedSilence `json:"silences"`
+	LongSilences []cachedSilence `json:"longSilences"`
+	Duration     float64         `json:"duration"`
+	Bitrate      float64         `json:"bitrate"`
+}
+
+// scanCache is keyed by (path, size, mtime, sha1-of-first-64KiB), so it
+// self-invalidates on any edit, rename-in-place, or truncation.
+type scanCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]scanCacheEntry
+}
+
+func loadScanCache(path string) *scanCache {
+	entries := map[string]scanCacheEntry{}
+
+	if path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			json.Unmarshal(data, &entries)
+		}
+	}
+
+	return &scanCache{path: path, entries: entries}
+}
+
+func scanCacheKey(path string, info os.FileInfo) (string, error) {
+	hash, err := hashFilePrefix(path, cachePrefixSize)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%d:%d:%s", path, info.Size(), info.ModTime().UnixNano(), hash), nil
+}
+
+func (c *scanCache) lookup(key string) (scanCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *scanCache) store(key string, entry scanCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = entry
+}
+
+func (c *scanCache) save() {
+	if c.path == "" {
+		return
+	}
+
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(c.path), os.ModePerm)
+	os.WriteFile(c.path, data, 0644)
+}
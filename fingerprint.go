@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const fingerprintHammingThreshold = 10
+
+var fingerprintLine = regexp.MustCompile(`FINGERPRINT=(.+)`)
+
+func fingerprintCachePath() string {
+	dir := cacheBaseDir()
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, "fingerprints.json")
+}
+
+func loadFingerprintCache() map[string]string {
+	cache := map[string]string{}
+
+	path := fingerprintCachePath()
+	if path == "" {
+		return cache
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+
+	json.Unmarshal(data, &cache)
+	return cache
+}
+
+func saveFingerprintCache(cache map[string]string) {
+	path := fingerprintCachePath()
+	if path == "" {
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+
+	os.WriteFile(path, data, 0644)
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// getFingerprint shells out to Chromaprint's fpcalc, mirroring how
+// getSilenceInfo shells out to ffmpeg and scrapes its stderr.
+func getFingerprint(path string) (string, error) {
+	output, err := exec.Command("fpcalc", "-raw", "-length", "120", path).CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+
+	match := fingerprintLine.FindStringSubmatch(string(output))
+	if match == nil {
+		return "", fmt.Errorf("fpcalc produced no fingerprint for %s", path)
+	}
+
+	return match[1], nil
+}
+
+func parseRawFingerprint(raw string) []uint32 {
+	parts := strings.Split(raw, ",")
+	values := make([]uint32, 0, len(parts))
+
+	for _, part := range parts {
+		v, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			continue
+		}
+		values = append(values, uint32(v))
+	}
+
+	return values
+}
+
+// fingerprintDistance is the Hamming distance between two raw Chromaprint
+// fingerprints, compared over their common length.
+func fingerprintDistance(a, b string) int {
+	fa := parseRawFingerprint(a)
+	fb := parseRawFingerprint(b)
+
+	length := len(fa)
+	if len(fb) < length {
+		length = len(fb)
+	}
+
+	if length == 0 {
+		return bits.UintSize
+	}
+
+	distance := 0
+	for i := 0; i < length; i++ {
+		distance += bits.OnesCount32(fa[i] ^ fb[i])
+	}
+
+	return distance
+}
+
+func allTracks(data *artistMap) []*track {
+	tracks := []*track{}
+
+	for _, artist := range *data {
+		for _, album := range artist.albums {
+			for _, disk := range album.tracks {
+				for _, track := range disk {
+					tracks = append(tracks, track)
+				}
+			}
+		}
+	}
+
+	return tracks
+}
+
+// groupDuplicates clusters tracks by fingerprint. It's a simple greedy
+// pass: each not-yet-grouped track starts a group and takes in every
+// other ungrouped track within fingerprintHammingThreshold of that first
+// track; members are not compared with each other.
+func groupDuplicates(tracks []*track) [][]*track {
+	groups := [][]*track{}
+	assigned := map[*track]bool{}
+
+	for _, t := range tracks {
+		if assigned[t] || t.fingerprint == "" {
+			continue
+		}
+
+		group := []*track{t}
+		assigned[t] = true
+
+		for _, other := range tracks {
+			if assigned[other] || other.fingerprint == "" {
+				continue
+			}
+
+			if fingerprintDistance(t.fingerprint, other.fingerprint) <= fingerprintHammingThreshold {
+				group = append(group, other)
+				assigned[other] = true
+			}
+		}
+
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// dedupe reports duplicate tracks found across the whole library and
+// removes every copy but the highest-bitrate one.
+func dedupe(data *artistMap) {
+	groups := groupDuplicates(allTracks(data))
+
+	if len(groups) == 0 {
+		fmt.Println("\nNo duplicates found")
+		return
+	}
+
+	fmt.Printf("\n%d %s found\n\n", len(groups), plural(uint(len(groups)), "duplicate", "duplicates"))
+
+	for _, group := range groups {
+		best := group[0]
+		for _, t := range group[1:] {
+			if t.bitrate > best.bitrate {
+				best = t
+			}
+		}
+
+		fmt.Println(best.artist.name, "-", best.album.name, "-", best.name)
+		for _, t := range group {
+			if t == best {
+				fmt.Println("  keeping ", t.path, fmt.Sprintf("(%gkb/s)", t.bitrate))
+				continue
+			}
+
+			fmt.Println("  removing", t.path, fmt.Sprintf("(%gkb/s)", t.bitrate))
+			os.Remove(t.path)
+		}
+	}
+}
+
+type acoustidRecording struct {
+	Title   string `json:"title"`
+	Artists []struct {
+		Name string `json:"name"`
+	} `json:"artists"`
+	ReleaseGroups []struct {
+		Title string `json:"title"`
+	} `json:"releasegroups"`
+}
+
+type acoustidResult struct {
+	Recordings []acoustidRecording `json:"recordings"`
+}
+
+type acoustidResponse struct {
+	Status  string           `json:"status"`
+	Results []acoustidResult `json:"results"`
+}
+
+// lookupAcoustID queries the AcoustID API for the top match of a
+// fingerprint/duration pair.
+func lookupAcoustID(apiKey, fingerprint string, duration float64) (*acoustidRecording, error) {
+	query := url.Values{}
+	query.Set("client", apiKey)
+	query.Set("fingerprint", fingerprint)
+	query.Set("duration", strconv.Itoa(int(duration)))
+	query.Set("meta", "recordings+releasegroups")
+
+	resp, err := http.Get("https://api.acoustid.org/v2/lookup?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var parsed acoustidResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	if parsed.Status != "ok" || len(parsed.Results) == 0 || len(parsed.Results[0].Recordings) == 0 {
+		return nil, nil
+	}
+
+	return &parsed.Results[0].Recordings[0], nil
+}
+
+// verifyTags queries AcoustID for every fingerprinted track and flags
+// ones whose stored artist/title/album disagree with the top match.
+func verifyTags(apiKey string, data *artistMap) {
+	fmt.Println("\nVerifying tags against AcoustID...")
+
+	for _, t := range allTracks(data) {
+		if t.fingerprint == "" {
+			continue
+		}
+
+		recording, err := lookupAcoustID(apiKey, t.fingerprint, t.duration)
+		if err != nil || recording == nil {
+			continue
+		}
+
+		artistMatch := len(recording.Artists) == 0
+		for _, a := range recording.Artists {
+			if strings.EqualFold(a.Name, t.artist.name) {
+				artistMatch = true
+			}
+		}
+
+		albumMatch := len(recording.ReleaseGroups) == 0
+		for _, rg := range recording.ReleaseGroups {
+			if strings.EqualFold(rg.Title, t.album.name) {
+				albumMatch = true
+			}
+		}
+
+		if !strings.EqualFold(recording.Title, t.name) || !artistMatch || !albumMatch {
+			matchArtist := "unknown artist"
+			if len(recording.Artists) > 0 {
+				matchArtist = recording.Artists[0].Name
+			}
+
+			matchAlbum := "unknown album"
+			if len(recording.ReleaseGroups) > 0 {
+				matchAlbum = recording.ReleaseGroups[0].Title
+			}
+
+			fmt.Printf("\n%s - %s\n  tagged as: %s - %s - %s\n  AcoustID match: %s - %s - %s\n",
+				t.album.name, t.name, t.artist.name, t.album.name, t.name, matchArtist, matchAlbum, recording.Title)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// format identifies the audio codec/container of a track, so ffmpeg
+// command construction can be centralized and keyed on a single enum
+// instead of being re-derived in every goroutine that shells out to it.
+type format int
+
+const (
+	formatUnknown format = iota
+	formatMP3
+	formatFLAC
+	formatOggVorbis
+	formatOpus
+	formatM4A
+)
+
+func (f format) String() string {
+	switch f {
+	case formatMP3:
+		return "mp3"
+	case formatFLAC:
+		return "flac"
+	case formatOggVorbis:
+		return "ogg"
+	case formatOpus:
+		return "opus"
+	case formatM4A:
+		return "m4a"
+	default:
+		return "unknown"
+	}
+}
+
+// guessFormat identifies a track's format from its extension, falling
+// back to sniffing magic bytes when the extension alone is ambiguous
+// (an .ogg container can hold either Vorbis or Opus).
+func guessFormat(path string) format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return formatMP3
+	case ".flac":
+		return formatFLAC
+	case ".opus":
+		return formatOpus
+	case ".m4a":
+		return formatM4A
+	case ".ogg", ".oga":
+		return sniffOggCodec(path)
+	default:
+		return formatUnknown
+	}
+}
+
+// sniffOggCodec distinguishes Vorbis from Opus inside an Ogg container by
+// looking at the first page's codec identification header.
+func sniffOggCodec(path string) format {
+	file, err := os.Open(path)
+	if err != nil {
+		return formatUnknown
+	}
+	defer file.Close()
+
+	header := make([]byte, 64)
+	n, _ := file.Read(header)
+	header = header[:n]
+
+	switch {
+	case bytes.Contains(header, []byte("OpusHead")):
+		return formatOpus
+	case bytes.Contains(header, []byte("vorbis")):
+		return formatOggVorbis
+	default:
+		return formatUnknown
+	}
+}
+
+// tmpPathFor returns the scratch path ffmpeg should write a remuxed copy
+// of path to. It keeps the original extension so ffmpeg infers the right
+// container from the output filename.
+func tmpPathFor(path string) string {
+	return path + ".tmp" + filepath.Ext(path)
+}
+
+// remuxArgs builds the ffmpeg argument list to extract [start, end] out of
+// path into tmpPath, one switch case per format so adding a new codec
+// doesn't require touching every goroutine that trims a track.
+func remuxArgs(path, tmpPath string, f format, start, end float64) []string {
+	args := []string{"-ss", fmt.Sprintf("%f", start), "-t", fmt.Sprintf("%f", end-start), "-i", path}
+
+	switch f {
+	case formatM4A:
+		args = append(args, "-c", "copy", "-movflags", "+faststart")
+	case formatOpus:
+		// Opus frames don't align with arbitrary trim points, so a copy
+		// remux would leave clicks at the cut; re-encode instead.
+		args = append(args, "-c:a", "libopus")
+	default:
+		args = append(args, "-codec", "copy")
+	}
+
+	return append(args, tmpPath)
+}
@@ -15,7 +15,7 @@ import (
 	"github.com/fatih/color"
 	"github.com/schollz/progressbar/v3"
 
-	"github.com/dhowden/tag"
+	"github.com/bogem/id3v2/v2"
 	"github.com/urfave/cli/v2"
 )
 
@@ -26,6 +26,7 @@ const (
 	minSilence       = 0.6
 	silenceTolerance = 0.4
 	workers          = 10
+	referenceLUFS    = -18.0
 )
 
 type artist struct {
@@ -38,17 +39,25 @@ type album struct {
 	name         string
 	tracks       map[int]map[int]*track
 	tracksByName map[string]*track
+	albumGain    float64
+	albumPeak    float64
 	*artist
 }
 
 type track struct {
 	name         string
 	path         string
+	format       format
 	trackNumber  int
 	diskNumber   int
+	year         int
 	silences     []silence
 	longSilences []silence
 	duration     float64
+	bitrate      float64
+	trackGain    float64
+	trackPeak    float64
+	fingerprint  string
 	*album
 }
 
@@ -71,13 +80,17 @@ type silence struct {
 }
 
 var (
-	duration     = regexp.MustCompile(`Duration: ([0-9]{2}):([0-9]{2}):([0-9\.]+), start: ([0-9\.]+), bitrate: [0-9\.]+ kb/s`)
+	duration     = regexp.MustCompile(`Duration: ([0-9]{2}):([0-9]{2}):([0-9\.]+), start: ([0-9\.]+), bitrate: ([0-9\.]+) kb/s`)
 	silenceStart = regexp.MustCompile(`\[silencedetect @ .*?\] silence_start: ([0-9\.]+)`)
 	silenceEnd   = regexp.MustCompile(`\[silencedetect @ .*?\] silence_end: ([0-9\.]+) \| silence_duration: [0-9\.]+`)
+
+	integratedLoudness = regexp.MustCompile(`I:\s+(-?[0-9\.]+) LUFS`)
+	truePeak           = regexp.MustCompile(`Peak:\s+(-?[0-9\.]+) dBFS`)
 )
 
-func getSilenceInfo(path string, longSilence bool) ([]silence, float64) {
+func getSilenceInfo(path string, longSilence bool) ([]silence, float64, float64) {
 	d := 0.0
+	bitrate := 0.0
 	result := []silence{}
 
 	silenceDetectArg := ""
@@ -119,45 +132,172 @@ func getSilenceInfo(path string, longSilence bool) ([]silence, float64) {
 			seconds, _ := strconv.ParseFloat(durationMatch[3], 64)
 			offset, _ := strconv.ParseFloat(durationMatch[4], 64)
 			d = hours*3600 + minutes*60 + seconds - offset
+			bitrate, _ = strconv.ParseFloat(durationMatch[5], 64)
 		}
 	}
 
-	return result, d
+	return result, d, bitrate
 }
 
-func getFolderData(folder string) *artistMap {
-	data := artistMap{}
+func getLoudnessInfo(path string) (lufs float64, peak float64) {
+	output, _ := exec.Command("ffmpeg", "-i", path, "-af", "ebur128=peak=true", "-f", "null", "-").CombinedOutput()
+	outputString := string(output)
 
-	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
-		if strings.ToLower(filepath.Ext(path)) != ".mp3" {
-			return nil
+	lines := strings.Split(strings.Replace(outputString, "\r\n", "\n", -1), "\n")
+
+	for _, line := range lines {
+		if match := integratedLoudness.FindStringSubmatch(line); match != nil {
+			lufs, _ = strconv.ParseFloat(match[1], 64)
+			continue
 		}
 
-		if err != nil {
-			return err
+		if match := truePeak.FindStringSubmatch(line); match != nil {
+			peak, _ = strconv.ParseFloat(match[1], 64)
 		}
+	}
+
+	return lufs, peak
+}
+
+func writeReplayGainTags(path string, trackGain, trackPeak, albumGain, albumPeak float64) error {
+	tag, err := id3v2.Open(path, id3v2.Options{Parse: true})
+	if err != nil {
+		return err
+	}
+	defer tag.Close()
+
+	frames := map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", trackGain),
+		"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", trackPeak),
+		"REPLAYGAIN_ALBUM_GAIN": fmt.Sprintf("%.2f dB", albumGain),
+		"REPLAYGAIN_ALBUM_PEAK": fmt.Sprintf("%.6f", albumPeak),
+	}
+
+	for description, value := range frames {
+		tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{
+			Encoding:    id3v2.EncodingUTF8,
+			Description: description,
+			Value:       value,
+		})
+	}
+
+	return tag.Save()
+}
+
+func lufsToGain(lufs float64) float64 {
+	return referenceLUFS - lufs
+}
+
+func dbfsToLinearPeak(dbfs float64) float64 {
+	return math.Pow(10, dbfs/20)
+}
+
+func computeReplayGain(data *artistMap) {
+	_, _, tracks := getStats(data)
+	fmt.Println("\nComputing ReplayGain...")
+
+	pb := progressbar.Default(int64(tracks))
+	wg := sync.WaitGroup{}
+
+	trackChannel := make(chan *track)
+
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			for track := range trackChannel {
+				lufs, peak := getLoudnessInfo(track.path)
+				track.trackGain = lufsToGain(lufs)
+				track.trackPeak = dbfsToLinearPeak(peak)
+				pb.Add(1)
+			}
+
+			wg.Done()
+		}()
+	}
+
+	for _, artist := range *data {
+		for _, album := range artist.albums {
+			for _, disk := range album.tracks {
+				for _, track := range disk {
+					trackChannel <- track
+				}
+			}
+		}
+	}
+
+	close(trackChannel)
+	wg.Wait()
+	pb.Finish()
+
+	for _, artist := range *data {
+		for _, album := range artist.albums {
+			energySum := 0.0
+			trackCount := 0.0
+			peak := 0.0
+
+			for _, disk := range album.tracks {
+				for _, track := range disk {
+					energySum += math.Pow(10, (referenceLUFS-track.trackGain)/10)
+					trackCount++
+					peak = math.Max(peak, track.trackPeak)
+				}
+			}
+
+			if trackCount == 0 {
+				continue
+			}
+
+			albumLUFS := 10 * math.Log10(energySum/trackCount)
+			album.albumGain = lufsToGain(albumLUFS)
+			album.albumPeak = peak
+
+			for _, disk := range album.tracks {
+				for _, track := range disk {
+					if track.format != formatMP3 {
+						// TXXX is an ID3v2 construct; writing it into any
+						// other container (e.g. prepending an ID3v2 blob
+						// in front of a FLAC file's "fLaC" magic) corrupts
+						// it. Report it instead of touching the file.
+						fmt.Printf("skipping ReplayGain tags for %s: %s tagging isn't supported yet\n", track.path, track.format)
+						continue
+					}
+
+					if err := writeReplayGainTags(track.path, track.trackGain, track.trackPeak, album.albumGain, album.albumPeak); err != nil {
+						fmt.Println(err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func getFolderData(folder string, reader tagReader) *artistMap {
+	data := artistMap{}
 
-		file, err := os.Open(path)
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		defer file.Close()
+		format := guessFormat(path)
+		if format == formatUnknown {
+			return nil
+		}
 
-		metadata, err := tag.ReadFrom(file)
+		metadata, err := reader.ReadTags(path)
 		if err != nil {
 			return err
 		}
 
-		artistName := strings.Trim(metadata.AlbumArtist(), " ")
+		artistName := strings.Trim(metadata.AlbumArtist, " ")
 		if artistName == "" {
-			artistName = strings.Trim(strings.Split(metadata.Artist(), ",")[0], " ")
+			artistName = strings.Trim(strings.Split(metadata.Artist, ",")[0], " ")
 		}
 
-		albumName := strings.Trim(metadata.Album(), " ")
-		diskNumber, _ := metadata.Disc()
-		trackNumber, _ := metadata.Track()
-		trackName := strings.Trim(metadata.Title(), " ")
+		albumName := strings.Trim(metadata.Album, " ")
+		diskNumber := metadata.Disc
+		trackNumber := metadata.Track
+		trackName := strings.Trim(metadata.Title, " ")
 
 		if data[artistName] == nil {
 			data[artistName] = &artist{
@@ -183,8 +323,10 @@ func getFolderData(folder string) *artistMap {
 		data[artistName].albums[albumName].tracks[diskNumber][trackNumber] = &track{
 			name:        trackName,
 			path:        path,
+			format:      format,
 			trackNumber: trackNumber,
 			diskNumber:  diskNumber,
+			year:        metadata.Year,
 			album:       data[artistName].albums[albumName],
 		}
 
@@ -307,21 +449,72 @@ func plural(n uint, singular string, plural string) string {
 	return plural
 }
 
-func analyse(data *artistMap) {
+// analyse runs ffmpeg silencedetect over every track missing from the
+// scan cache (every track when forceRescan is set), and, when
+// fingerprint is set, Chromaprint fingerprinting too — both in the same
+// worker/channel pass, so a --dedupe or --verify-tags run doesn't pay for
+// a second full pass over the library on top of this one.
+func analyse(data *artistMap, cache *scanCache, forceRescan bool, fingerprint bool) {
 	artists, albums, tracks := getStats(data)
 	fmt.Printf("\nAnalysing %d %s, %d %s and %d %s...\n", artists, plural(artists, "artist", "artists"), albums, plural(albums, "album", "albums"), tracks, plural(tracks, "track", "tracks"))
 
 	pb := progressbar.Default(int64(tracks))
 	wg := sync.WaitGroup{}
 
-	trackChannel := make(chan *track)
+	type scanJob struct {
+		track        *track
+		key          string
+		needsSilence bool
+	}
+
+	var fingerprintCache map[string]string
+	var fingerprintCacheMutex sync.Mutex
+	if fingerprint {
+		fingerprintCache = loadFingerprintCache()
+	}
+
+	jobChannel := make(chan scanJob)
 
 	for n := 0; n < workers; n++ {
 		wg.Add(1)
 		go func() {
-			for track := range trackChannel {
-				track.silences, track.duration = getSilenceInfo(track.path, false)
-				track.longSilences, _ = getSilenceInfo(track.path, true)
+			for job := range jobChannel {
+				track := job.track
+
+				if job.needsSilence {
+					track.silences, track.duration, track.bitrate = getSilenceInfo(track.path, false)
+					track.longSilences, _, _ = getSilenceInfo(track.path, true)
+
+					if job.key != "" {
+						cache.store(job.key, scanCacheEntry{
+							Silences:     silencesToCache(track.silences),
+							LongSilences: silencesToCache(track.longSilences),
+							Duration:     track.duration,
+							Bitrate:      track.bitrate,
+						})
+					}
+				}
+
+				if fingerprint {
+					if hash, err := hashFile(track.path); err == nil {
+						fingerprintCacheMutex.Lock()
+						fp, cached := fingerprintCache[hash]
+						fingerprintCacheMutex.Unlock()
+
+						if !cached {
+							fp, err = getFingerprint(track.path)
+						}
+
+						if err == nil {
+							track.fingerprint = fp
+
+							fingerprintCacheMutex.Lock()
+							fingerprintCache[hash] = fp
+							fingerprintCacheMutex.Unlock()
+						}
+					}
+				}
+
 				pb.Add(1)
 			}
 
@@ -333,15 +526,44 @@ func analyse(data *artistMap) {
 		for _, album := range artist.albums {
 			for _, disk := range album.tracks {
 				for _, track := range disk {
-					trackChannel <- track
+					key := ""
+					needsSilence := true
+
+					if info, err := os.Stat(track.path); err == nil {
+						if k, err := scanCacheKey(track.path, info); err == nil {
+							key = k
+						}
+					}
+
+					if key != "" && !forceRescan {
+						if entry, ok := cache.lookup(key); ok {
+							track.silences = silencesFromCache(entry.Silences)
+							track.longSilences = silencesFromCache(entry.LongSilences)
+							track.duration = entry.Duration
+							track.bitrate = entry.Bitrate
+							needsSilence = false
+						}
+					}
+
+					if !needsSilence && !fingerprint {
+						pb.Add(1)
+						continue
+					}
+
+					jobChannel <- scanJob{track: track, key: key, needsSilence: needsSilence}
 				}
 			}
 		}
 	}
 
-	close(trackChannel)
+	close(jobChannel)
 	wg.Wait()
 	pb.Finish()
+	cache.save()
+
+	if fingerprint {
+		saveFingerprintCache(fingerprintCache)
+	}
 }
 
 func countProblems(data *artistMap) (problems uint, fixable uint) {
@@ -489,12 +711,13 @@ func fixProblems(fixable uint, data *artistMap) {
 				}
 
 				if start != 0 || end != track.duration {
-					os.Remove(track.path + ".tmp.mp3")
-					cmd := exec.Command("ffmpeg", "-ss", fmt.Sprintf("%f", start), "-t", fmt.Sprintf("%f", end-start), "-i", track.path, "-codec", "copy", track.path+".tmp.mp3")
+					tmpPath := tmpPathFor(track.path)
+					os.Remove(tmpPath)
+					cmd := exec.Command("ffmpeg", remuxArgs(track.path, tmpPath, track.format, start, end)...)
 					err := cmd.Run()
 					if err == nil {
 						os.Remove(track.path)
-						os.Rename(track.path+".tmp.mp3", track.path)
+						os.Rename(tmpPath, track.path)
 					}
 				}
 
@@ -527,30 +750,6 @@ func escape(path string) string {
 	return wrongChars.ReplaceAllLiteralString(path, "-")
 }
 
-func sortData(folder string, data *artistMap) {
-	for _, artist := range *data {
-		os.Mkdir(filepath.Join(folder, escape(artist.name)), os.ModePerm)
-		for _, album := range artist.albums {
-			os.Mkdir(filepath.Join(folder, escape(artist.name), escape(album.name)), os.ModePerm)
-			for diskNumber, disk := range album.tracks {
-				for trackNumber, track := range disk {
-					fileName := ""
-
-					if len(album.tracks) > 1 {
-						fileName += fmt.Sprintf("%02d - ", diskNumber)
-					}
-
-					fileName += fmt.Sprintf("%02d %s.mp3", trackNumber, escape(track.name))
-					err := os.Rename(track.path, filepath.Join(folder, escape(artist.name), escape(album.name), fileName))
-					if err != nil {
-						fmt.Println(err)
-					}
-				}
-			}
-		}
-	}
-}
-
 func main() {
 	app := &cli.App{
 		Name:  "mp3-check",
@@ -566,6 +765,57 @@ func main() {
 				Value: false,
 				Usage: "sort music collection",
 			},
+			&cli.StringFlag{
+				Name:  "sort-template",
+				Usage: "text/template used to sort tracks (fields: Artist, AlbumArtist, Album, Year, Disc, Track, Title, Ext; helper: pad)",
+			},
+			&cli.BoolFlag{
+				Name:  "collection",
+				Value: false,
+				Usage: "skip tracks already laid out as 'Artist - Album', keeping --sort idempotent",
+			},
+			&cli.BoolFlag{
+				Name:  "replaygain",
+				Value: false,
+				Usage: "compute and write ReplayGain tags",
+			},
+			&cli.StringFlag{
+				Name:  "tag-backend",
+				Value: "dhowden",
+				Usage: "tag reading backend to use (dhowden, taglib)",
+			},
+			&cli.BoolFlag{
+				Name:  "dedupe",
+				Value: false,
+				Usage: "find and remove duplicate tracks by acoustic fingerprint",
+			},
+			&cli.BoolFlag{
+				Name:  "verify-tags",
+				Value: false,
+				Usage: "flag tracks whose tags disagree with their AcoustID match",
+			},
+			&cli.StringFlag{
+				Name:  "acoustid-api-key",
+				Usage: "AcoustID API key, required by --verify-tags",
+			},
+			&cli.BoolFlag{
+				Name:  "force-rescan",
+				Value: false,
+				Usage: "bypass the scan cache and re-run ffmpeg on every file",
+			},
+			&cli.StringFlag{
+				Name:  "cache-path",
+				Usage: "path to the scan cache file (defaults under $XDG_CACHE_HOME/mp3-check)",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "text",
+				Usage: "output format for the problem report (text, json)",
+			},
+			&cli.StringFlag{
+				Name:  "report",
+				Usage: "write the JSON report to this file instead of stdout (implies --format json)",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			folder := "."
@@ -573,29 +823,76 @@ func main() {
 				folder = c.Args().Get(0)
 			}
 
-			data := getFolderData(folder)
+			reader, err := newTagReader(c.String("tag-backend"))
+			if err != nil {
+				return err
+			}
 
-			if c.Bool("fix") || !c.Bool("sort") {
-				analyse(data)
+			cachePath := c.String("cache-path")
+			if cachePath == "" {
+				cachePath = defaultScanCachePath()
+			}
+			cache := loadScanCache(cachePath)
+
+			data := getFolderData(folder, reader)
+
+			// --dedupe needs every track's bitrate (to prefer the best
+			// copy) and --verify-tags needs its duration (for the AcoustID
+			// lookup), both of which only analyse() populates; both also
+			// need a fingerprint, which analyse() computes in the same
+			// pass when asked.
+			needsFingerprint := c.Bool("dedupe") || c.Bool("verify-tags")
+			if c.Bool("fix") || !c.Bool("sort") || needsFingerprint {
+				analyse(data, cache, c.Bool("force-rescan"), needsFingerprint)
 			}
 
+			jsonOutput := c.String("format") == "json" || c.String("report") != ""
+
 			if !c.Bool("fix") && !c.Bool("sort") {
-				logProblems(data)
+				if jsonOutput {
+					if err := writeReport(c.String("report"), buildReport(data)); err != nil {
+						return err
+					}
+				} else {
+					logProblems(data)
+				}
 			}
 
 			var problems, fixable uint
 
 			if c.Bool("fix") || !c.Bool("sort") {
 				problems, fixable = countProblems(data)
-				printProblemNumber(problems, fixable)
+				if !jsonOutput {
+					printProblemNumber(problems, fixable)
+				}
 			}
 
 			if c.Bool("fix") {
 				fixProblems(fixable, data)
 			}
 
+			if c.Bool("replaygain") {
+				computeReplayGain(data)
+			}
+
+			if c.Bool("dedupe") {
+				dedupe(data)
+			}
+
+			if c.Bool("verify-tags") {
+				if c.String("acoustid-api-key") == "" {
+					return fmt.Errorf("--verify-tags requires --acoustid-api-key")
+				}
+				verifyTags(c.String("acoustid-api-key"), data)
+			}
+
 			if c.Bool("sort") {
-				sortData(folder, data)
+				tmpl, err := parseSortTemplate(c.String("sort-template"))
+				if err != nil {
+					return err
+				}
+
+				sortData(folder, data, tmpl, c.Bool("collection"))
 			}
 
 			return nil
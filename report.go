@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// reportSchema is bumped whenever the JSON report's shape changes, so
+// downstream consumers (CI, scripts, GUIs) can detect breaking changes.
+const reportSchema = 1
+
+type silenceReport struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type trackProblems struct {
+	TruncatedBeginning   bool `json:"truncatedBeginning"`
+	OverlapBeginning     bool `json:"overlapBeginning"`
+	HugeSilenceBeginning bool `json:"hugeSilenceBeginning"`
+	HugeSilenceEnd       bool `json:"hugeSilenceEnd"`
+	OverlapEnd           bool `json:"overlapEnd"`
+	TruncatedEnd         bool `json:"truncatedEnd"`
+}
+
+func (p trackProblems) any() bool {
+	return p.TruncatedBeginning || p.OverlapBeginning || p.HugeSilenceBeginning ||
+		p.HugeSilenceEnd || p.OverlapEnd || p.TruncatedEnd
+}
+
+func (p trackProblems) fixable() bool {
+	return !p.TruncatedBeginning && !p.TruncatedEnd && p.any()
+}
+
+type trackReport struct {
+	Path     string          `json:"path"`
+	Artist   string          `json:"artist"`
+	Album    string          `json:"album"`
+	Disk     int             `json:"disk"`
+	Track    int             `json:"track"`
+	Title    string          `json:"title"`
+	Duration float64         `json:"duration"`
+	Silences []silenceReport `json:"silences"`
+	Problems trackProblems   `json:"problems"`
+	Fixable  bool            `json:"fixable"`
+}
+
+type reportCounts struct {
+	Artists  uint `json:"artists"`
+	Albums   uint `json:"albums"`
+	Tracks   uint `json:"tracks"`
+	Problems uint `json:"problems"`
+	Fixable  uint `json:"fixable"`
+}
+
+type report struct {
+	Schema int           `json:"schema"`
+	Counts reportCounts  `json:"counts"`
+	Tracks []trackReport `json:"tracks"`
+}
+
+func silencesToReport(s []silence) []silenceReport {
+	out := make([]silenceReport, len(s))
+	for i, v := range s {
+		out[i] = silenceReport{Start: v.start, End: v.end}
+	}
+
+	return out
+}
+
+func buildReport(data *artistMap) report {
+	artists, albums, tracks := getStats(data)
+	problems, fixable := countProblems(data)
+
+	r := report{
+		Schema: reportSchema,
+		Counts: reportCounts{Artists: artists, Albums: albums, Tracks: tracks, Problems: problems, Fixable: fixable},
+		Tracks: []trackReport{},
+	}
+
+	for _, artist := range *data {
+		for _, album := range artist.albums {
+			for diskNumber, disk := range album.tracks {
+				for trackNumber, track := range disk {
+					problems := trackProblems{
+						TruncatedBeginning:   truncatedAtTheBeginning(track),
+						OverlapBeginning:     overlapsAtTheBeginning(track),
+						HugeSilenceBeginning: hugeSilenceAtTheBeginning(track),
+						HugeSilenceEnd:       hugeSilenceAtTheEnd(track),
+						OverlapEnd:           overlapsAtTheEnd(track),
+						TruncatedEnd:         truncatedAtTheEnd(track),
+					}
+
+					path := track.path
+					if abs, err := filepath.Abs(path); err == nil {
+						path = abs
+					}
+
+					r.Tracks = append(r.Tracks, trackReport{
+						Path:     path,
+						Artist:   artist.name,
+						Album:    album.name,
+						Disk:     diskNumber,
+						Track:    trackNumber,
+						Title:    track.name,
+						Duration: track.duration,
+						Silences: silencesToReport(track.silences),
+						Problems: problems,
+						Fixable:  problems.fixable(),
+					})
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+// writeReport marshals r as indented JSON to path, or to stdout when path
+// is empty.
+func writeReport(path string, r report) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
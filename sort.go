@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// defaultSortTemplate reproduces the layout sortData used to hardcode:
+// <artist>/<album>/[DD - ]TT Title.ext.
+const defaultSortTemplate = `{{.Artist}}/{{.Album}}/{{if gt .Disc 0}}{{pad .Disc 2}} - {{end}}{{pad .Track 2}} {{.Title}}{{.Ext}}`
+
+// collectionLayout matches an "Artist - Album"-style flat directory name,
+// the layout --collection recognizes as already sorted.
+var collectionLayout = regexp.MustCompile(`.+ - .+`)
+
+func sortTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"pad": func(n int, width int) string {
+			return fmt.Sprintf("%0*d", width, n)
+		},
+	}
+}
+
+// parseSortTemplate compiles a --sort-template string, exposing the named
+// fields documented for it: Artist, AlbumArtist, Album, Year, Disc, Track,
+// Title, Ext, plus the pad helper.
+func parseSortTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultSortTemplate
+	}
+
+	return template.New("sort").Funcs(sortTemplateFuncs()).Parse(text)
+}
+
+type sortFields struct {
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Year        int
+	Disc        int
+	Track       int
+	Title       string
+	Ext         string
+}
+
+// alreadyInCollectionLayout reports whether path already lives under a
+// directory matching the flat "Artist - Album" layout, so --collection
+// can skip it and stay idempotent across repeat runs.
+func alreadyInCollectionLayout(path string) bool {
+	return collectionLayout.MatchString(filepath.Base(filepath.Dir(path)))
+}
+
+// renderSortPath executes tmpl and escapes each "/"-delimited path
+// component separately, so slashes coming from the template's own
+// separators still create subdirectories while slashes inside a field
+// value (e.g. a title) get sanitized like every other wrong character.
+func renderSortPath(tmpl *template.Template, fields sortFields) (string, error) {
+	fields.Artist = escape(fields.Artist)
+	fields.AlbumArtist = escape(fields.AlbumArtist)
+	fields.Album = escape(fields.Album)
+	fields.Title = escape(fields.Title)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(buf.String(), "/")
+	escaped := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		escaped = append(escaped, escape(part))
+	}
+
+	return filepath.Join(escaped...), nil
+}
+
+func sortData(folder string, data *artistMap, tmpl *template.Template, collection bool) {
+	for _, artist := range *data {
+		for _, album := range artist.albums {
+			// Only expose the disc number to the template when the album
+			// actually spans multiple disks, so the default template's
+			// single-disc layout matches the one sortData used to hardcode.
+			disc := 0
+
+			for diskNumber, disk := range album.tracks {
+				if len(album.tracks) > 1 {
+					disc = diskNumber
+				}
+
+				for trackNumber, track := range disk {
+					if collection && alreadyInCollectionLayout(track.path) {
+						continue
+					}
+
+					relPath, err := renderSortPath(tmpl, sortFields{
+						Artist:      artist.name,
+						AlbumArtist: artist.name,
+						Album:       album.name,
+						Year:        track.year,
+						Disc:        disc,
+						Track:       trackNumber,
+						Title:       track.name,
+						Ext:         filepath.Ext(track.path),
+					})
+					if err != nil {
+						fmt.Println(err)
+						continue
+					}
+
+					dest := filepath.Join(folder, relPath)
+					os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+
+					if err := os.Rename(track.path, dest); err != nil {
+						fmt.Println(err)
+					}
+				}
+			}
+		}
+	}
+}
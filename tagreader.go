@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dhowden/tag"
+)
+
+// tags is the subset of metadata mp3-check needs from an audio file,
+// independent of which underlying library read it. Cover art isn't part
+// of it yet: nothing downstream consumes it, and until it's needed it
+// should stay out rather than leak a dhowden/tag type through the
+// interface.
+type tags struct {
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Title       string
+	Track       int
+	Disc        int
+	Year        int
+}
+
+// tagReader reads tags out of an audio file. Backends are swappable so the
+// artist/album/track graph construction never depends on a specific
+// tagging library.
+type tagReader interface {
+	ReadTags(path string) (tags, error)
+}
+
+// dhowdenTagReader is the default, pure-Go backend backed by
+// github.com/dhowden/tag.
+type dhowdenTagReader struct{}
+
+func (dhowdenTagReader) ReadTags(path string) (tags, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return tags{}, err
+	}
+	defer file.Close()
+
+	metadata, err := tag.ReadFrom(file)
+	if err != nil {
+		return tags{}, err
+	}
+
+	track, _ := metadata.Track()
+	disc, _ := metadata.Disc()
+
+	return tags{
+		Artist:      metadata.Artist(),
+		AlbumArtist: metadata.AlbumArtist(),
+		Album:       metadata.Album(),
+		Title:       metadata.Title(),
+		Track:       track,
+		Disc:        disc,
+		Year:        metadata.Year(),
+	}, nil
+}
+
+// newTagReader selects a tagReader backend by name, as passed to
+// --tag-backend. The taglib backend is only available in builds compiled
+// with -tags taglib.
+func newTagReader(backend string) (tagReader, error) {
+	switch backend {
+	case "", "dhowden":
+		return dhowdenTagReader{}, nil
+	case "taglib":
+		return newTaglibTagReader()
+	default:
+		return nil, fmt.Errorf("unknown tag backend %q", backend)
+	}
+}
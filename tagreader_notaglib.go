@@ -0,0 +1,11 @@
+//go:build !taglib
+
+package main
+
+import "fmt"
+
+// newTaglibTagReader is stubbed out in default builds; rebuild with
+// -tags taglib to enable the cgo-based TagLib backend.
+func newTaglibTagReader() (tagReader, error) {
+	return nil, fmt.Errorf("mp3-check was built without taglib support; rebuild with -tags taglib")
+}
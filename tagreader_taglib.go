@@ -0,0 +1,34 @@
+//go:build taglib
+
+package main
+
+import (
+	taglib "github.com/wtolson/go-taglib"
+)
+
+// taglibTagReader is a cgo-based backend on top of TagLib. It fills the
+// same fields of tags as dhowdenTagReader; cover art and user-defined
+// TXXX frames are not read, and the artist is TagLib's single string.
+type taglibTagReader struct{}
+
+func newTaglibTagReader() (tagReader, error) {
+	return taglibTagReader{}, nil
+}
+
+func (taglibTagReader) ReadTags(path string) (tags, error) {
+	file, err := taglib.Read(path)
+	if err != nil {
+		return tags{}, err
+	}
+	defer file.Close()
+
+	return tags{
+		Artist:      file.Artist(),
+		AlbumArtist: file.AlbumArtist(),
+		Album:       file.Album(),
+		Title:       file.Title(),
+		Track:       int(file.Track()),
+		Disc:        int(file.Disc()),
+		Year:        int(file.Year()),
+	}, nil
+}